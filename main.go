@@ -1,21 +1,59 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
-	DefaultPort = "8080"
+	DefaultPort              = "8080"
+	DefaultReadHeaderTimeout = 5 * time.Second
+	DefaultReadTimeout       = 15 * time.Second
+	DefaultWriteTimeout      = 15 * time.Second
+	DefaultIdleTimeout       = 60 * time.Second
+	DefaultDrainDelay        = 5 * time.Second
+	DefaultShutdownTimeout   = 10 * time.Second
+	DefaultAutocertCacheDir  = "autocert-cache"
 )
 
 type Config struct {
-	Port        string
-	ContainerID string
+	Port              string
+	ContainerID       string
+	TrustedProxies    []*net.IPNet
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	DrainDelay        time.Duration
+	ShutdownTimeout   time.Duration
+	MetricsPort       string
+	TLSCertFile       string
+	TLSKeyFile        string
+	AutocertHosts     []string
+	AutocertCacheDir  string
+	InsecureHTTPS     bool
 }
 
 func loadConfig() Config {
@@ -29,21 +67,345 @@ func loadConfig() Config {
 		containerID = "N/A"
 	}
 
+	autocertCacheDir := os.Getenv("AUTOCERT_CACHE_DIR")
+	if autocertCacheDir == "" {
+		autocertCacheDir = DefaultAutocertCacheDir
+	}
+
 	return Config{
-		Port:        port,
-		ContainerID: containerID,
+		Port:              port,
+		ContainerID:       containerID,
+		TrustedProxies:    parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")),
+		ReadHeaderTimeout: durationFromEnv("READ_HEADER_TIMEOUT", DefaultReadHeaderTimeout),
+		ReadTimeout:       durationFromEnv("READ_TIMEOUT", DefaultReadTimeout),
+		WriteTimeout:      durationFromEnv("WRITE_TIMEOUT", DefaultWriteTimeout),
+		IdleTimeout:       durationFromEnv("IDLE_TIMEOUT", DefaultIdleTimeout),
+		DrainDelay:        durationFromEnv("DRAIN_DELAY", DefaultDrainDelay),
+		ShutdownTimeout:   durationFromEnv("SHUTDOWN_TIMEOUT", DefaultShutdownTimeout),
+		MetricsPort:       os.Getenv("METRICS_PORT"),
+		TLSCertFile:       os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:        os.Getenv("TLS_KEY_FILE"),
+		AutocertHosts:     splitAndTrim(os.Getenv("AUTOCERT_HOSTS")),
+		AutocertCacheDir:  autocertCacheDir,
+		InsecureHTTPS:     os.Getenv("HTTPS_INSECURE") == "true",
 	}
 }
 
+// splitAndTrim splits a comma-separated env var into its trimmed,
+// non-empty entries.
+func splitAndTrim(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// durationFromEnv parses key as a time.Duration (e.g. "5s"), falling
+// back to def if the env var is unset or invalid.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		slog.Warn("Ignoring invalid duration env var", "key", key, "value", raw, "error", err)
+		return def
+	}
+	return d
+}
+
+// appState holds process-wide state shared across handlers: whether
+// the server is accepting new traffic, and how many requests are
+// currently in flight (used to size the shutdown drain delay).
+type appState struct {
+	ready    atomic.Bool
+	inFlight atomic.Int64
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs (e.g.
+// "10.0.0.0/8,172.16.0.0/12") into IP networks. Invalid entries are
+// logged and skipped rather than rejecting the whole list.
+func parseTrustedProxies(raw string) []*net.IPNet {
+	if raw == "" {
+		return nil
+	}
+
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 32
+				if ip.To4() == nil {
+					bits = 128
+				}
+				entry = entry + "/" + strconv.Itoa(bits)
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			slog.Warn("Ignoring invalid TRUSTED_PROXIES entry", "entry", entry, "error", err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
 type IPResponse struct {
 	ServerIP string `json:"serverIP"`
 	ClientIP string `json:"clientIP"`
+	Proto    string `json:"proto,omitempty"`
+	Host     string `json:"host,omitempty"`
 }
 
 type ConfigResponse struct {
 	ContainerID string `json:"containerID"`
 }
 
+// TLSResponse reports what the current connection actually negotiated,
+// so clients can confirm HTTPS/HTTP2 made it end-to-end rather than
+// being terminated upstream.
+type TLSResponse struct {
+	Proto   string `json:"proto"`
+	Version string `json:"tlsVersion"`
+}
+
+// handleTLS reports the negotiated ALPN protocol and TLS version for
+// the current connection, or "http"/"none" when not served over TLS.
+func handleTLS(w http.ResponseWriter, r *http.Request) {
+	response := TLSResponse{Proto: "http", Version: "none"}
+	if r.TLS != nil {
+		response.Proto = r.TLS.NegotiatedProtocol
+		if response.Proto == "" {
+			response.Proto = "http/1.1"
+		}
+		response.Version = tls.VersionName(r.TLS.Version)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Failed to encode JSON response", "error", err)
+	}
+}
+
+// generateSelfSignedCert creates an in-memory, self-signed localhost
+// certificate for the "https+insecure" dev shortcut, so TLS can be
+// exercised without provisioning real certs.
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generating serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("creating certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// metricDurationBuckets are the histogram bucket upper bounds (in
+// seconds) for http_request_duration_seconds, matching the Traefik
+// defaults.
+var metricDurationBuckets = []float64{0.1, 0.3, 1.2, 5}
+
+// metricsRegistry accumulates RED-method metrics (rate, errors,
+// duration) in Prometheus text-exposition format. Label sets are kept
+// to (method, path, status) so that path is always a registered route
+// pattern, never a raw URL, to avoid cardinality explosions.
+type metricsRegistry struct {
+	mu              sync.Mutex
+	requestsTotal   map[[3]string]int64
+	durationBuckets map[[2]string][]int64
+	durationSum     map[[2]string]float64
+	durationCount   map[[2]string]int64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requestsTotal:   make(map[[3]string]int64),
+		durationBuckets: make(map[[2]string][]int64),
+		durationSum:     make(map[[2]string]float64),
+		durationCount:   make(map[[2]string]int64),
+	}
+}
+
+// observe records one completed request against the registry.
+func (reg *metricsRegistry) observe(method, path, status string, duration time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.requestsTotal[[3]string{method, path, status}]++
+
+	key := [2]string{method, path}
+	buckets, ok := reg.durationBuckets[key]
+	if !ok {
+		buckets = make([]int64, len(metricDurationBuckets)+1) // +1 for the +Inf bucket
+		reg.durationBuckets[key] = buckets
+	}
+	seconds := duration.Seconds()
+	for i, le := range metricDurationBuckets {
+		if seconds <= le {
+			buckets[i]++
+		}
+	}
+	buckets[len(metricDurationBuckets)]++ // +Inf always matches
+	reg.durationSum[key] += seconds
+	reg.durationCount[key]++
+}
+
+// render produces the Prometheus text-exposition format for everything
+// recorded so far, plus the given in-flight gauge value.
+func (reg *metricsRegistry) render(inFlight int64) string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# HELP http_requests_total Total number of HTTP requests.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	for _, key := range sortedKeys3(reg.requestsTotal) {
+		fmt.Fprintf(&b, "http_requests_total{method=%q,path=%q,status=%q} %d\n",
+			key[0], key[1], key[2], reg.requestsTotal[key])
+	}
+
+	b.WriteString("# HELP http_request_duration_seconds HTTP request latency in seconds.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, key := range sortedKeys2(reg.durationBuckets) {
+		method, path := key[0], key[1]
+		buckets := reg.durationBuckets[key]
+		for i, le := range metricDurationBuckets {
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket{method=%q,path=%q,le=\"%v\"} %d\n",
+				method, path, le, buckets[i])
+		}
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{method=%q,path=%q,le=\"+Inf\"} %d\n",
+			method, path, buckets[len(metricDurationBuckets)])
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum{method=%q,path=%q} %v\n",
+			method, path, reg.durationSum[key])
+		fmt.Fprintf(&b, "http_request_duration_seconds_count{method=%q,path=%q} %d\n",
+			method, path, reg.durationCount[key])
+	}
+
+	b.WriteString("# HELP http_requests_in_flight Number of HTTP requests currently being served.\n")
+	b.WriteString("# TYPE http_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", inFlight)
+
+	return b.String()
+}
+
+func sortedKeys3(m map[[3]string]int64) [][3]string {
+	keys := make([][3]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return lessKey3(keys[i], keys[j]) })
+	return keys
+}
+
+func lessKey3(a, b [3]string) bool {
+	if a[0] != b[0] {
+		return a[0] < b[0]
+	}
+	if a[1] != b[1] {
+		return a[1] < b[1]
+	}
+	return a[2] < b[2]
+}
+
+func sortedKeys2(m map[[2]string][]int64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status
+// code and byte count written, since neither is otherwise observable
+// after the handler returns.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// instrumentMetrics wraps handler to record request counts and latency
+// against reg. routePattern is the pattern the handler was registered
+// under (e.g. "/api/ip"), not the raw request path, so dynamic
+// segments and static-file URLs don't blow up label cardinality.
+func instrumentMetrics(reg *metricsRegistry, routePattern string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := newStatusRecorder(w)
+		start := time.Now()
+		handler.ServeHTTP(rec, r)
+		reg.observe(r.Method, routePattern, strconv.Itoa(rec.status), time.Since(start))
+	})
+}
+
+// handleMetrics serves the accumulated metrics in Prometheus text
+// format.
+func handleMetrics(reg *metricsRegistry, state *appState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(reg.render(state.inFlight.Load())))
+	}
+}
+
 func main() {
 	// Configure structured logger with JSON output
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
@@ -52,66 +414,276 @@ func main() {
 	// Load configuration
 	config := loadConfig()
 
-	// Serve static files with logging
+	state := &appState{}
+	state.ready.Store(true)
+
+	metrics := newMetricsRegistry()
+	mux := http.NewServeMux()
+
+	// route registers handler under pattern with the standard
+	// access-log + metrics instrumentation applied.
+	route := func(pattern string, handler http.Handler) {
+		mux.Handle(pattern, accessLog(config.TrustedProxies, instrumentMetrics(metrics, pattern, handler)))
+	}
+
+	// Serve static files
 	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/", logRequest(fs))
+	route("/", fs)
 
 	// API endpoint for IP addresses
-	http.HandleFunc("/api/ip", handleIP)
+	route("/api/ip", handleIPWithConfig(config))
 
 	// API endpoint for config
-	http.HandleFunc("/api/config", handleConfigWithConfig(config))
+	route("/api/config", handleConfigWithConfig(config))
+
+	// Liveness: the process is up and able to handle HTTP at all.
+	route("/livez", http.HandlerFunc(handleLivez))
+
+	// Readiness: false while draining, so a load balancer stops sending
+	// new traffic before the server actually stops listening.
+	route("/readyz", handleReadyz(state))
+
+	// Reports what the connection actually negotiated, for verifying
+	// TLS/HTTP2 made it end-to-end.
+	route("/api/tls", http.HandlerFunc(handleTLS))
+
+	// Back-compat alias for the old combined health check; labeled the
+	// same as /readyz since it serves the same handler.
+	mux.Handle("/health", accessLog(config.TrustedProxies, instrumentMetrics(metrics, "/readyz", handleReadyz(state))))
+
+	// The metrics listener defaults to the public mux, but can be moved
+	// to its own port via METRICS_PORT so /metrics isn't exposed
+	// publicly.
+	var metricsServer *http.Server
+	if config.MetricsPort == "" {
+		route("/metrics", handleMetrics(metrics, state))
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", accessLog(config.TrustedProxies, handleMetrics(metrics, state)))
+		metricsServer = &http.Server{
+			Addr:    ":" + config.MetricsPort,
+			Handler: metricsMux,
+		}
+		go func() {
+			slog.Info("Metrics server starting", "port", config.MetricsPort)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Metrics server failed", "error", err)
+			}
+		}()
+	}
 
-	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	server := &http.Server{
+		Addr:              ":" + config.Port,
+		Handler:           countInFlight(state, mux),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
 
-	slog.Info("Server starting", "port", config.Port)
-	if err := http.ListenAndServe(":"+config.Port, nil); err != nil {
-		slog.Error("Server failed", "error", err)
+	// TLS mode, in order of precedence: ACME autocert, static cert
+	// files, then the "https+insecure" self-signed dev shortcut. HTTP/2
+	// is enabled automatically by ListenAndServeTLS via the standard
+	// library defaults whenever TLS is in play.
+	var redirectServer *http.Server
+	switch {
+	case len(config.AutocertHosts) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.AutocertHosts...),
+			Cache:      autocert.DirCache(config.AutocertCacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		redirectServer = &http.Server{
+			Addr:    ":80",
+			Handler: manager.HTTPHandler(nil),
+		}
+	case config.TLSCertFile != "" && config.TLSKeyFile != "":
+		// Loaded by ListenAndServeTLS itself; nothing to set up here.
+	case config.TLSCertFile != "" || config.TLSKeyFile != "":
+		slog.Error("TLS_CERT_FILE and TLS_KEY_FILE must both be set; falling back to plain HTTP")
+	case config.InsecureHTTPS:
+		cert, err := generateSelfSignedCert()
+		if err != nil {
+			slog.Error("Failed to generate self-signed certificate", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	serverErrs := make(chan error, 1)
+	go func() {
+		var err error
+		switch {
+		case server.TLSConfig != nil:
+			slog.Info("Server starting", "port", config.Port, "tls", true)
+			err = server.ListenAndServeTLS("", "")
+		case config.TLSCertFile != "" && config.TLSKeyFile != "":
+			slog.Info("Server starting", "port", config.Port, "tls", true)
+			err = server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		default:
+			slog.Info("Server starting", "port", config.Port, "tls", false)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			serverErrs <- err
+			return
+		}
+		serverErrs <- nil
+	}()
+
+	if redirectServer != nil {
+		go func() {
+			slog.Info("HTTP redirect listener starting for ACME challenges", "port", 80)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("HTTP redirect listener failed", "error", err)
+			}
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serverErrs:
+		if err != nil {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	case sig := <-sigCh:
+		slog.Info("Shutdown signal received, draining", "signal", sig.String())
+	}
+
+	// Flip readiness first so the load balancer stops routing new
+	// requests here, then give in-flight connections time to finish
+	// before we actually stop listening.
+	state.ready.Store(false)
+	slog.Info("Waiting for drain delay", "delay", config.DrainDelay, "in_flight", state.inFlight.Load())
+	time.Sleep(config.DrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Graceful shutdown failed", "error", err)
 		os.Exit(1)
 	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			slog.Error("Metrics server shutdown failed", "error", err)
+		}
+	}
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			slog.Error("HTTP redirect listener shutdown failed", "error", err)
+		}
+	}
+	slog.Info("Server stopped")
+}
+
+// handleLivez reports whether the process itself is alive. It never
+// fails once the server has started: restarting a live-but-not-ready
+// pod would not help readiness recover.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handleReadyz reports whether the server should receive new traffic.
+// It flips to unready during the shutdown drain so a load balancer can
+// stop routing here before the listener actually closes.
+func handleReadyz(state *appState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !state.ready.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
 }
 
-// logRequest wraps an http.Handler to log incoming requests
-func logRequest(handler http.Handler) http.Handler {
+// countInFlight tracks the number of requests currently being served,
+// so the shutdown drain delay can be tuned against real traffic.
+func countInFlight(state *appState, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state.inFlight.Add(1)
+		defer state.inFlight.Add(-1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// accessLog wraps handler with a structured access log modeled after
+// gorilla/handlers' CombinedLoggingHandler: it generates or propagates
+// an X-Request-Id, captures status code and bytes written, measures
+// latency, and resolves the real client IP via the trusted-proxy
+// logic. One slog record is emitted per request, after the handler
+// returns.
+func accessLog(trustedProxies []*net.IPNet, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = generateRequestID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		rec := newStatusRecorder(w)
+		start := time.Now()
+		handler.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		client := getClientIP(r, trustedProxies)
+
 		slog.Info("Request",
+			"request_id", requestID,
 			"method", r.Method,
 			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", duration.Milliseconds(),
+			"client_ip", client.IP,
 			"remote_addr", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+			"referer", r.Referer(),
 		)
-		handler.ServeHTTP(w, r)
 	})
 }
 
-func handleIP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// generateRequestID returns a random 16-character hex identifier for
+// correlating one request's logs together.
+func generateRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
+	return hex.EncodeToString(b[:])
+}
 
-	slog.Info("Request",
-		"method", r.Method,
-		"path", r.URL.Path,
-		"remote_addr", r.RemoteAddr,
-	)
+func handleIPWithConfig(config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	response := IPResponse{
-		ServerIP: getServerIP(),
-		ClientIP: getClientIP(r),
-	}
+		client := getClientIP(r, config.TrustedProxies)
 
-	slog.Info("Serving IPs",
-		"server_ip", response.ServerIP,
-		"client_ip", response.ClientIP,
-	)
+		response := IPResponse{
+			ServerIP: getServerIP(),
+			ClientIP: client.IP,
+			Proto:    client.Proto,
+			Host:     client.Host,
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		slog.Error("Failed to encode JSON response", "error", err)
+		slog.Info("Serving IPs",
+			"server_ip", response.ServerIP,
+			"client_ip", response.ClientIP,
+		)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			slog.Error("Failed to encode JSON response", "error", err)
+		}
 	}
 }
 
@@ -138,27 +710,201 @@ func getServerIP() string {
 	return "Unknown"
 }
 
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (for proxies/load balancers)
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(forwarded, ",")
-		return strings.TrimSpace(ips[0])
+// ClientIPInfo is the result of resolving the real client IP for a
+// request, along with whatever the proxy chain told us about the
+// original protocol and the Host the client requested.
+type ClientIPInfo struct {
+	IP    string
+	Proto string
+	Host  string
+}
+
+// getClientIP resolves the real client IP for r. Forwarded headers
+// (X-Forwarded-For, X-Real-IP, Forwarded) are only honored when
+// r.RemoteAddr is within one of trustedProxies; otherwise RemoteAddr
+// itself is the answer, since an untrusted caller can set those
+// headers to anything it likes.
+func getClientIP(r *http.Request, trustedProxies []*net.IPNet) ClientIPInfo {
+	remoteHost := hostOnly(r.RemoteAddr)
+	remoteIP := net.ParseIP(remoteHost)
+
+	if !ipTrusted(remoteIP, trustedProxies) {
+		return ClientIPInfo{IP: remoteHost}
+	}
+
+	// RFC 7239 Forwarded header takes precedence: it is the standardized
+	// replacement for the de-facto X-Forwarded-* headers and carries
+	// proto/by alongside the client address.
+	if forwarded := r.Header.Get("Forwarded"); forwarded != "" {
+		if info, ok := resolveFromForwarded(forwarded, trustedProxies); ok {
+			return info
+		}
 	}
 
-	// Check X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
+	// X-Forwarded-For can contain a chain of "client, proxy1, proxy2, ...".
+	// Walk it right-to-left, skipping trusted proxy hops, until we find
+	// the first untrusted (or unparseable-as-trusted) address: that's
+	// the real client.
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			candidate := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(stripBrackets(candidate))
+			if ip == nil {
+				continue
+			}
+			if !ipTrusted(ip, trustedProxies) {
+				return ClientIPInfo{IP: ip.String()}
+			}
+		}
+	}
+
+	// X-Real-IP is a single address set by the immediate proxy.
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		if ip := net.ParseIP(stripBrackets(strings.TrimSpace(realIP))); ip != nil {
+			return ClientIPInfo{IP: ip.String()}
+		}
 	}
 
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return ClientIPInfo{IP: remoteHost}
+}
+
+// hostOnly strips the port from a host:port address, tolerating a bare
+// host (no port) as RemoteAddr is documented to sometimes be in tests.
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return r.RemoteAddr
+		return addr
+	}
+	return host
+}
+
+func ipTrusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripBrackets removes the "[...]" wrapping RFC 7239/IPv6 addresses
+// use to disambiguate the address from a trailing ":port", and trims
+// any port that survives.
+func stripBrackets(s string) string {
+	if strings.HasPrefix(s, "[") {
+		if end := strings.Index(s, "]"); end != -1 {
+			return s[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
+
+// resolveFromForwarded parses an RFC 7239 Forwarded header and walks
+// its elements right-to-left the same way as X-Forwarded-For, skipping
+// trusted hops until it finds the real client.
+func resolveFromForwarded(header string, trustedProxies []*net.IPNet) (ClientIPInfo, bool) {
+	elements := parseForwardedHeader(header)
+	for i := len(elements) - 1; i >= 0; i-- {
+		el := elements[i]
+		ip := net.ParseIP(stripBrackets(el["for"]))
+		if ip == nil {
+			continue
+		}
+		if !ipTrusted(ip, trustedProxies) {
+			return ClientIPInfo{
+				IP:    ip.String(),
+				Proto: el["proto"],
+				Host:  stripBrackets(el["host"]),
+			}, true
+		}
+	}
+	return ClientIPInfo{}, false
+}
+
+// parseForwardedHeader parses the value of a Forwarded header into its
+// comma-separated elements, each a map of lowercased parameter name to
+// unquoted value, e.g. `for=192.0.2.60;proto=http;host=example.com`.
+// Elements and parameters are split on top-level commas/semicolons only,
+// so a quoted-string value (e.g. `for="[2001:db8::1]:4711"`) may safely
+// contain either separator.
+func parseForwardedHeader(header string) []map[string]string {
+	var elements []map[string]string
+	for _, part := range splitForwardedTopLevel(header, ',') {
+		params := map[string]string{}
+		for _, pair := range splitForwardedTopLevel(part, ';') {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(kv[0]))
+			value := unquoteForwardedValue(strings.TrimSpace(kv[1]))
+			params[key] = value
+		}
+		if len(params) > 0 {
+			elements = append(elements, params)
+		}
+	}
+	return elements
+}
+
+// splitForwardedTopLevel splits s on sep, but ignores any sep that falls
+// inside an RFC 7239 quoted-string, so `for="a,b"` isn't split on the
+// comma between the quotes.
+func splitForwardedTopLevel(s string, sep byte) []string {
+	var parts []string
+	var cur strings.Builder
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && inQuotes && i+1 < len(s) {
+			cur.WriteByte(c)
+			i++
+			cur.WriteByte(s[i])
+			continue
+		}
+		if c == '"' {
+			inQuotes = !inQuotes
+			cur.WriteByte(c)
+			continue
+		}
+		if c == sep && !inQuotes {
+			parts = append(parts, cur.String())
+			cur.Reset()
+			continue
+		}
+		cur.WriteByte(c)
+	}
+	parts = append(parts, cur.String())
+	return parts
+}
+
+// unquoteForwardedValue strips the surrounding quotes from an RFC 7239
+// quoted-string value and resolves its quoted-pair ("\" CHAR) escapes;
+// unquoted values pass through unchanged.
+func unquoteForwardedValue(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	inner := value[1 : len(value)-1]
+	var b strings.Builder
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '\\' && i+1 < len(inner) {
+			i++
+		}
+		b.WriteByte(inner[i])
 	}
-	return ip
+	return b.String()
 }
 
 func handleConfigWithConfig(config Config) http.HandlerFunc {
@@ -168,12 +914,6 @@ func handleConfigWithConfig(config Config) http.HandlerFunc {
 			return
 		}
 
-		slog.Info("Request",
-			"method", r.Method,
-			"path", r.URL.Path,
-			"remote_addr", r.RemoteAddr,
-		)
-
 		response := ConfigResponse{
 			ContainerID: config.ContainerID,
 		}
@@ -191,12 +931,6 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slog.Info("Request",
-		"method", r.Method,
-		"path", r.URL.Path,
-		"remote_addr", r.RemoteAddr,
-	)
-
 	containerID := os.Getenv("CONTAINER_ID")
 	if containerID == "" {
 		containerID = "N/A"
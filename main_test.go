@@ -1,20 +1,49 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
+func mustTrustedProxies(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	networks, err := parseTrustedProxiesForTest(cidrs)
+	if err != nil {
+		t.Fatalf("failed to build trusted proxies: %v", err)
+	}
+	return networks
+}
+
+func parseTrustedProxiesForTest(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func TestGetClientIP(t *testing.T) {
 	tests := []struct {
-		name              string
-		remoteAddr        string
-		xForwardedFor     string
-		xRealIP           string
-		expectedIP        string
+		name           string
+		remoteAddr     string
+		trustedProxies []*net.IPNet
+		xForwardedFor  string
+		xRealIP        string
+		forwarded      string
+		expectedIP     string
+		expectedProto  string
+		expectedHost   string
 	}{
 		{
 			name:       "direct connection",
@@ -22,35 +51,46 @@ func TestGetClientIP(t *testing.T) {
 			expectedIP: "192.168.1.1",
 		},
 		{
-			name:          "X-Forwarded-For single IP",
+			name:          "X-Forwarded-For from untrusted proxy is ignored",
 			remoteAddr:    "10.0.0.1:12345",
 			xForwardedFor: "203.0.113.1",
-			expectedIP:    "203.0.113.1",
+			expectedIP:    "10.0.0.1",
 		},
 		{
-			name:          "X-Forwarded-For multiple IPs",
-			remoteAddr:    "10.0.0.1:12345",
-			xForwardedFor: "203.0.113.1, 198.51.100.1, 10.0.0.1",
-			expectedIP:    "203.0.113.1",
+			name:           "X-Forwarded-For single IP from trusted proxy",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			xForwardedFor:  "203.0.113.1",
+			expectedIP:     "203.0.113.1",
 		},
 		{
-			name:          "X-Forwarded-For with spaces",
-			remoteAddr:    "10.0.0.1:12345",
-			xForwardedFor: "  203.0.113.1  ",
-			expectedIP:    "203.0.113.1",
+			name:           "X-Forwarded-For multiple IPs skips trusted hops",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8", "198.51.100.0/24"),
+			xForwardedFor:  "203.0.113.1, 198.51.100.1, 10.0.0.1",
+			expectedIP:     "203.0.113.1",
 		},
 		{
-			name:       "X-Real-IP",
-			remoteAddr: "10.0.0.1:12345",
-			xRealIP:    "203.0.113.1",
-			expectedIP: "203.0.113.1",
+			name:           "X-Forwarded-For with spaces",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			remoteAddr:     "10.0.0.1:12345",
+			xForwardedFor:  "  203.0.113.1  ",
+			expectedIP:     "203.0.113.1",
 		},
 		{
-			name:          "X-Forwarded-For takes precedence over X-Real-IP",
-			remoteAddr:    "10.0.0.1:12345",
-			xForwardedFor: "203.0.113.1",
-			xRealIP:       "198.51.100.1",
-			expectedIP:    "203.0.113.1",
+			name:           "X-Real-IP from trusted proxy",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			xRealIP:        "203.0.113.1",
+			expectedIP:     "203.0.113.1",
+		},
+		{
+			name:           "X-Forwarded-For takes precedence over X-Real-IP",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			xForwardedFor:  "203.0.113.1",
+			xRealIP:        "198.51.100.1",
+			expectedIP:     "203.0.113.1",
 		},
 		{
 			name:       "IPv6 address",
@@ -62,6 +102,47 @@ func TestGetClientIP(t *testing.T) {
 			remoteAddr: "192.168.1.1",
 			expectedIP: "192.168.1.1",
 		},
+		{
+			name:           "invalid X-Forwarded-For entry falls through",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			xForwardedFor:  "invalidIPString",
+			expectedIP:     "10.0.0.1",
+		},
+		{
+			name:           "Forwarded header from trusted proxy",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			forwarded:      `for=203.0.113.1;proto=https;host=example.com`,
+			expectedIP:     "203.0.113.1",
+			expectedProto:  "https",
+			expectedHost:   "example.com",
+		},
+		{
+			name:           "Forwarded header with quoted IPv6",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			forwarded:      `for="[2001:db8::1]:4711";proto=https`,
+			expectedIP:     "2001:db8::1",
+			expectedProto:  "https",
+		},
+		{
+			name:           "Forwarded header with quoted host containing a separator",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			forwarded:      `for=203.0.113.1;proto=https;host="example.com;x=1,y=2"`,
+			expectedIP:     "203.0.113.1",
+			expectedProto:  "https",
+			expectedHost:   "example.com;x=1,y=2",
+		},
+		{
+			name:           "Forwarded header takes precedence over X-Forwarded-For",
+			remoteAddr:     "10.0.0.1:12345",
+			trustedProxies: mustTrustedProxies(t, "10.0.0.0/8"),
+			forwarded:      `for=203.0.113.1`,
+			xForwardedFor:  "198.51.100.1",
+			expectedIP:     "203.0.113.1",
+		},
 	}
 
 	for _, tt := range tests {
@@ -74,23 +155,45 @@ func TestGetClientIP(t *testing.T) {
 			if tt.xRealIP != "" {
 				req.Header.Set("X-Real-IP", tt.xRealIP)
 			}
+			if tt.forwarded != "" {
+				req.Header.Set("Forwarded", tt.forwarded)
+			}
 
-			got := getClientIP(req)
-			if got != tt.expectedIP {
-				t.Errorf("getClientIP() = %v, want %v", got, tt.expectedIP)
+			got := getClientIP(req, tt.trustedProxies)
+			if got.IP != tt.expectedIP {
+				t.Errorf("getClientIP().IP = %v, want %v", got.IP, tt.expectedIP)
+			}
+			if got.Proto != tt.expectedProto {
+				t.Errorf("getClientIP().Proto = %v, want %v", got.Proto, tt.expectedProto)
+			}
+			if got.Host != tt.expectedHost {
+				t.Errorf("getClientIP().Host = %v, want %v", got.Host, tt.expectedHost)
 			}
 		})
 	}
 }
 
+func TestParseTrustedProxies(t *testing.T) {
+	networks := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, not-a-cidr")
+	if len(networks) != 2 {
+		t.Fatalf("parseTrustedProxies() returned %d networks, want 2", len(networks))
+	}
+	if !networks[0].Contains(net.ParseIP("10.1.2.3")) {
+		t.Errorf("expected 10.0.0.0/8 to contain 10.1.2.3")
+	}
+	if !networks[1].Contains(net.ParseIP("192.168.1.1")) {
+		t.Errorf("expected bare IP 192.168.1.1 to be treated as a /32")
+	}
+}
+
 func TestGetServerIP(t *testing.T) {
 	// This test just verifies the function returns something valid
 	ip := getServerIP()
-	
+
 	if ip == "" {
 		t.Error("getServerIP() returned empty string")
 	}
-	
+
 	if ip != "Unknown" {
 		// If not "Unknown", should be a valid IP
 		if net.ParseIP(ip) == nil {
@@ -138,10 +241,10 @@ func TestHandleIP(t *testing.T) {
 			req.RemoteAddr = "192.168.1.1:12345"
 			w := httptest.NewRecorder()
 
-			handleIP(w, req)
+			handleIPWithConfig(Config{})(w, req)
 
 			if w.Code != tt.expectedStatus {
-				t.Errorf("handleIP() status = %v, want %v", w.Code, tt.expectedStatus)
+				t.Errorf("handleIPWithConfig() status = %v, want %v", w.Code, tt.expectedStatus)
 			}
 
 			if tt.checkBody {
@@ -225,13 +328,13 @@ func TestHandleConfig(t *testing.T) {
 	}
 }
 
-func TestLogRequestMiddleware(t *testing.T) {
+func TestAccessLogMiddleware(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
-	wrapped := logRequest(handler)
+	wrapped := accessLog(nil, handler)
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	w := httptest.NewRecorder()
@@ -239,10 +342,181 @@ func TestLogRequestMiddleware(t *testing.T) {
 	wrapped.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
-		t.Errorf("logRequest middleware changed status code: got %v, want %v", w.Code, http.StatusOK)
+		t.Errorf("accessLog middleware changed status code: got %v, want %v", w.Code, http.StatusOK)
 	}
 
 	if w.Body.String() != "OK" {
-		t.Errorf("logRequest middleware changed response body: got %v, want OK", w.Body.String())
+		t.Errorf("accessLog middleware changed response body: got %v, want OK", w.Body.String())
+	}
+
+	if got := w.Header().Get("X-Request-Id"); got == "" {
+		t.Error("accessLog middleware did not set X-Request-Id")
+	}
+}
+
+func TestAccessLogMiddlewarePropagatesRequestID(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	wrapped := accessLog(nil, handler)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "caller-supplied-id")
+	w := httptest.NewRecorder()
+
+	wrapped.ServeHTTP(w, req)
+
+	if got := w.Header().Get("X-Request-Id"); got != "caller-supplied-id" {
+		t.Errorf("accessLog middleware X-Request-Id = %v, want caller-supplied-id", got)
+	}
+}
+
+func TestGenerateRequestID(t *testing.T) {
+	a := generateRequestID()
+	b := generateRequestID()
+	if a == "" || b == "" {
+		t.Fatal("generateRequestID() returned an empty string")
+	}
+	if a == b {
+		t.Error("generateRequestID() returned the same id twice")
+	}
+}
+
+func TestHandleLivez(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/livez", nil)
+	w := httptest.NewRecorder()
+
+	handleLivez(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("handleLivez() status = %v, want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	state := &appState{}
+	state.ready.Store(true)
+	handler := handleReadyz(state)
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("handleReadyz() while ready status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	state.ready.Store(false)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("handleReadyz() while draining status = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestMetricsRegistryRender(t *testing.T) {
+	reg := newMetricsRegistry()
+	reg.observe(http.MethodGet, "/api/ip", "200", 50*time.Millisecond)
+	reg.observe(http.MethodGet, "/api/ip", "200", 2*time.Second)
+
+	out := reg.render(3)
+
+	if !strings.Contains(out, `http_requests_total{method="GET",path="/api/ip",status="200"} 2`) {
+		t.Errorf("render() missing requests_total line, got:\n%s", out)
+	}
+	if !strings.Contains(out, `http_request_duration_seconds_bucket{method="GET",path="/api/ip",le="0.1"} 1`) {
+		t.Errorf("render() missing 0.1s bucket count, got:\n%s", out)
+	}
+	if !strings.Contains(out, `http_request_duration_seconds_bucket{method="GET",path="/api/ip",le="+Inf"} 2`) {
+		t.Errorf("render() missing +Inf bucket count, got:\n%s", out)
+	}
+	if !strings.Contains(out, `http_request_duration_seconds_count{method="GET",path="/api/ip"} 2`) {
+		t.Errorf("render() missing duration count, got:\n%s", out)
+	}
+	if !strings.Contains(out, "http_requests_in_flight 3") {
+		t.Errorf("render() missing in-flight gauge, got:\n%s", out)
+	}
+}
+
+func TestInstrumentMetrics(t *testing.T) {
+	reg := newMetricsRegistry()
+	handler := instrumentMetrics(reg, "/api/ip", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/ip?x=1", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	out := reg.render(0)
+	if !strings.Contains(out, `http_requests_total{method="GET",path="/api/ip",status="418"} 1`) {
+		t.Errorf("instrumentMetrics() did not record route pattern / status, got:\n%s", out)
+	}
+}
+
+func TestCountInFlight(t *testing.T) {
+	state := &appState{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := countInFlight(state, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+
+	<-started
+	if got := state.inFlight.Load(); got != 1 {
+		t.Errorf("countInFlight() in_flight while serving = %v, want 1", got)
+	}
+	close(release)
+	<-done
+
+	if got := state.inFlight.Load(); got != 0 {
+		t.Errorf("countInFlight() left in_flight = %v, want 0", got)
+	}
+}
+
+func TestHandleTLS(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/tls", nil)
+	w := httptest.NewRecorder()
+
+	handleTLS(w, req)
+
+	var response TLSResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("handleTLS() failed to decode response: %v", err)
+	}
+	if response.Proto != "http" || response.Version != "none" {
+		t.Errorf("handleTLS() over plain HTTP = %+v, want {http none}", response)
+	}
+
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, NegotiatedProtocol: "h2"}
+	w = httptest.NewRecorder()
+	handleTLS(w, req)
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("handleTLS() failed to decode response: %v", err)
+	}
+	if response.Proto != "h2" || response.Version != "TLS 1.3" {
+		t.Errorf("handleTLS() over TLS = %+v, want {h2 TLS 1.3}", response)
+	}
+}
+
+func TestGenerateSelfSignedCert(t *testing.T) {
+	cert, err := generateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert() error = %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse generated certificate: %v", err)
+	}
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("generated certificate does not cover localhost: %v", err)
 	}
 }